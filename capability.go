@@ -0,0 +1,61 @@
+// +build linux
+
+package darity
+
+import "errors"
+
+// kvmCheckExtension is the ioctl used to query KVM_CHECK_EXTENSION, taken
+// from <linux/kvm.h>. It is issued against the KVM device fd for global
+// capabilities, or a VM fd for capabilities whose availability depends on
+// how that VM was created.
+const kvmCheckExtension = 44547
+
+// Capability identifies an optional KVM feature or per-host limit that can
+// be queried with Client.CheckExtension or VM.CheckExtension.
+type Capability int
+
+// Capabilities taken from the KVM_CAP_* constants in <linux/kvm.h>.
+const (
+	CapUserMemory    Capability = 3
+	CapSetTSSAddr    Capability = 4
+	CapIRQChip       Capability = 0
+	CapNrVCPUs       Capability = 9
+	CapNrMemslots    Capability = 10
+	CapSyncMMU       Capability = 16
+	CapCoalescedMMIO Capability = 15
+	CapMaxVCPUs      Capability = 66
+	CapImmediateExit Capability = 136
+)
+
+// ErrCapabilityUnavailable is returned by Client.CheckExtension and
+// VM.CheckExtension when KVM_CHECK_EXTENSION reports that the host does
+// not support the requested Capability.
+var ErrCapabilityUnavailable = errors.New("capability unavailable")
+
+// CheckExtension queries whether the host's KVM implementation supports
+// cap, returning a capability-specific value (often a limit, sometimes
+// just non-zero to mean "supported") on success.
+func (c *Client) CheckExtension(cap Capability) (int, error) {
+	return checkExtension(c.ioctl, c.kvm.Fd(), cap)
+}
+
+// CheckExtension queries whether v supports cap. Some capabilities (for
+// example ones affecting memory slots or VCPU limits) can only be queried
+// accurately on a VM fd, since they may depend on how the VM was created.
+func (v *VM) CheckExtension(cap Capability) (int, error) {
+	return checkExtension(v.ioctl, v.fd, cap)
+}
+
+// checkExtension issues KVM_CHECK_EXTENSION against fd using ioctl, and
+// translates a zero result into ErrCapabilityUnavailable.
+func checkExtension(ioctl ioctlFunc, fd uintptr, cap Capability) (int, error) {
+	r, err := ioctl(fd, kvmCheckExtension, uintptr(cap))
+	if err != nil {
+		return 0, err
+	}
+	if r == 0 {
+		return 0, ErrCapabilityUnavailable
+	}
+
+	return int(r), nil
+}
@@ -0,0 +1,86 @@
+// +build linux
+
+package darity
+
+import (
+	"errors"
+	"testing"
+)
+
+// errIoctlFailed is a stand-in for a genuine ioctl failure (bad fd, EPERM,
+// etc.), distinct from ErrCapabilityUnavailable.
+var errIoctlFailed = errors.New("ioctl failed")
+
+// TestVMCheckExtensionUnavailable verifies that VM.CheckExtension
+// translates a zero return value into ErrCapabilityUnavailable.
+func TestVMCheckExtensionUnavailable(t *testing.T) {
+	v := &VM{
+		ioctl: func(fd uintptr, request int, argp uintptr) (uintptr, error) {
+			if request != kvmCheckExtension {
+				t.Fatalf("unexpected ioctl request number: %d", request)
+			}
+			return 0, nil
+		},
+	}
+
+	if _, err := v.CheckExtension(CapImmediateExit); err != ErrCapabilityUnavailable {
+		t.Fatalf("unexpected error: %v != %v", ErrCapabilityUnavailable, err)
+	}
+}
+
+// TestVMAddVCPUFallsBackToDefault verifies that AddVCPU falls back to
+// kvmDefaultNrVCPUs when the host implements neither CapMaxVCPUs nor
+// CapNrVCPUs.
+func TestVMAddVCPUFallsBackToDefault(t *testing.T) {
+	v := &VM{
+		ioctl: func(fd uintptr, request int, argp uintptr) (uintptr, error) {
+			switch request {
+			case kvmCheckExtension:
+				return 0, nil
+			case kvmCreateVCPU:
+				return 3, nil
+			default:
+				t.Fatalf("unexpected ioctl request number: %d", request)
+				return 0, nil
+			}
+		},
+	}
+
+	if err := v.AddVCPU(kvmDefaultNrVCPUs); err != nil {
+		t.Fatalf("could not add VCPU within default limit: %q", err.Error())
+	}
+
+	if err := v.AddVCPU(kvmDefaultNrVCPUs + 1); err == nil {
+		t.Fatal("expected error adding VCPU beyond default limit, got none")
+	}
+}
+
+// TestVMMaxVCPUsPropagatesIoctlError verifies that maxVCPUs surfaces a
+// genuine CheckExtension failure instead of silently falling back to
+// kvmDefaultNrVCPUs.
+func TestVMMaxVCPUsPropagatesIoctlError(t *testing.T) {
+	v := &VM{
+		ioctl: func(fd uintptr, request int, argp uintptr) (uintptr, error) {
+			return 0, errIoctlFailed
+		},
+	}
+
+	if _, err := v.maxVCPUs(); !errors.Is(err, errIoctlFailed) {
+		t.Fatalf("unexpected error: %v != %v", errIoctlFailed, err)
+	}
+}
+
+// TestVMMaxMemorySlotsPropagatesIoctlError verifies that MaxMemorySlots
+// surfaces a genuine CheckExtension failure instead of silently falling
+// back to kvmDefaultNrMemslots.
+func TestVMMaxMemorySlotsPropagatesIoctlError(t *testing.T) {
+	v := &VM{
+		ioctl: func(fd uintptr, request int, argp uintptr) (uintptr, error) {
+			return 0, errIoctlFailed
+		},
+	}
+
+	if _, err := v.MaxMemorySlots(); !errors.Is(err, errIoctlFailed) {
+		t.Fatalf("unexpected error: %v != %v", errIoctlFailed, err)
+	}
+}
@@ -2,11 +2,38 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"unsafe"
 
 	"github.com/kitschysynq/darity"
+	"github.com/kitschysynq/darity/device"
 )
 
+// helloWorldCode is a tiny 16-bit real-mode stub, assembled by hand, that
+// writes "Hi\n" to the legacy COM1 port (0x3f8) one byte at a time via
+// OUT, then halts:
+//
+//	mov al, 'H'
+//	mov dx, 0x3f8
+//	out dx, al
+//	mov al, 'i'
+//	out dx, al
+//	mov al, 0x0a
+//	out dx, al
+//	hlt
+var helloWorldCode = []byte{
+	0xb0, 0x48,
+	0xba, 0xf8, 0x03,
+	0xee,
+	0xb0, 0x69,
+	0xee,
+	0xb0, 0x0a,
+	0xee,
+	0xf4,
+}
+
 func main() {
 	kvm, err := darity.New()
 	if err != nil {
@@ -28,13 +55,70 @@ func main() {
 		return
 	}
 
+	const slotSize = 128 << 20
+	var lowMemory []byte
 	for i := 0; i < 4; i++ {
-		if err := vm.AddMemorySlot(128<<20, 0); err != nil {
+		m, err := vm.AddMemorySlot(uint64(i)*slotSize, slotSize, 0)
+		if err != nil {
 			fmt.Printf("error adding memory slot: %q\n", err.Error())
 			return
 		}
 
-		m := vm.Memory[i]
 		fmt.Printf("memory: slot: %02d, size: %d, offset: %d\n", m.Slot, m.MemorySize, m.GuestPhysAddr)
+
+		if m.GuestPhysAddr == 0 {
+			// helloWorldCode runs at guest physical address 0, where the
+			// VCPU's CS:IP is pointed below, so keep a handle to the
+			// slot backing it.
+			lowMemory = unsafe.Slice((*byte)(unsafe.Pointer(uintptr(m.UserspaceAddr))), m.MemorySize)
+		}
+	}
+
+	// Registering a Serial8250 at the legacy COM1 port lets a guest
+	// print to stdout once (*darity.VCPU).RunUntil is driving it.
+	if err := vm.RegisterIODevice(0x3f8, 8, device.NewSerial8250(0x3f8, os.Stdout)); err != nil {
+		fmt.Printf("error registering serial device: %q\n", err.Error())
+		return
+	}
+
+	copy(lowMemory, helloWorldCode)
+
+	vc, err := vm.CreateVCPU(0)
+	if err != nil {
+		fmt.Printf("error creating vcpu: %q\n", err.Error())
+		return
+	}
+	defer vc.Close()
+
+	sregs, err := vc.GetSregs()
+	if err != nil {
+		fmt.Printf("error getting sregs: %q\n", err.Error())
+		return
+	}
+	// Point CS at guest physical address 0 rather than the BIOS reset
+	// vector KVM defaults to, since that's where helloWorldCode was
+	// copied above.
+	sregs.CS.Base = 0
+	sregs.CS.Selector = 0
+	if err := vc.SetSregs(sregs); err != nil {
+		fmt.Printf("error setting sregs: %q\n", err.Error())
+		return
+	}
+
+	regs, err := vc.GetRegs()
+	if err != nil {
+		fmt.Printf("error getting regs: %q\n", err.Error())
+		return
+	}
+	regs.RIP = 0
+	regs.RFLAGS = 0x2 // bit 1 is reserved and must always be set
+	if err := vc.SetRegs(regs); err != nil {
+		fmt.Printf("error setting regs: %q\n", err.Error())
+		return
+	}
+
+	if err := vc.RunUntil(context.Background()); err != nil {
+		fmt.Printf("error running vcpu: %q\n", err.Error())
+		return
 	}
 }
@@ -8,7 +8,8 @@ import (
 	"fmt"
 	"os"
 	"syscall"
-	"unsafe"
+
+	"github.com/kitschysynq/darity/device"
 )
 
 const (
@@ -26,12 +27,21 @@ const (
 
 // Constants taken from from <linux/kvm.h>, so cgo is not necessary.
 const (
-	kvmCapNrVCPUS = 9
-
-	kvmGetAPIVersion       = 44544
-	kvmCreateVM            = 44545
-	kvmCreateVCPU          = 44609
-	kvmSetUserMemoryRegion = 1075883590
+	// kvmDefaultNrVCPUs is the fallback maximum VCPU count used by
+	// AddVCPU when the host implements neither CapMaxVCPUs nor
+	// CapNrVCPUs.
+	kvmDefaultNrVCPUs = 4
+
+	// kvmDefaultNrMemslots is the fallback maximum memory slot count
+	// used by MaxMemorySlots when the host does not implement
+	// CapNrMemslots.
+	kvmDefaultNrMemslots = 32
+
+	kvmGetAPIVersion   = 44544
+	kvmCreateVM        = 44545
+	kvmGetVCPUMmapSize = 44548
+	kvmCreateVCPU      = 44609
+	kvmRun             = 44672
 )
 
 // MachineType specifies the type of the VM to be created. Paraphrasing the
@@ -55,8 +65,9 @@ var (
 	//   value other than 12.
 	ErrIncorrectVersion = errors.New("incorrect KVM version")
 
-	// ErrTooManyVCPUS is returned when a more than kvmCapMaxCPUS is requested.
-	ErrTooManyVCPUS = fmt.Errorf("a maximum of %d VCPUs are supported.", kvmCapNrVCPUS)
+	// ErrTooManyVCPUS is returned when more VCPUs are requested than the
+	// host supports for a given VM; see AddVCPU.
+	ErrTooManyVCPUS = errors.New("too many VCPUs requested")
 )
 
 // Client is a KVM client, and can perform actions using the KVM virtual device,
@@ -67,6 +78,10 @@ type Client struct {
 
 	// ioctl syscall implementation
 	ioctl ioctlFunc
+
+	// Size in bytes of the kvm_run shared memory page mmapped for each
+	// VCPU, as reported by KVM_GET_VCPU_MMAP_SIZE.
+	vcpuMmapSize int
 }
 
 // New returns a new Client, after performing some sanity checks to ensure that
@@ -100,6 +115,15 @@ func New() (*Client, error) {
 		return nil, ErrIncorrectVersion
 	}
 
+	// Cache the per-VCPU kvm_run mmap size so CreateVM doesn't need to
+	// re-query it for every VM it creates.
+	size, err := c.ioctl(c.kvm.Fd(), kvmGetVCPUMmapSize, 0)
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	c.vcpuMmapSize = int(size)
+
 	return c, nil
 }
 
@@ -123,10 +147,9 @@ func (c *Client) CreateVM(t MachineType) (*VM, error) {
 		return nil, err
 	}
 	return &VM{
-		Memory: make([]*MemorySlot, 0),
-
-		fd:    v,
-		ioctl: c.ioctl,
+		fd:           v,
+		ioctl:        c.ioctl,
+		vcpuMmapSize: c.vcpuMmapSize,
 	}, nil
 }
 
@@ -134,9 +157,6 @@ func (c *Client) CreateVM(t MachineType) (*VM, error) {
 // perform actions specified in api.txt as "vm ioctl" such as creating
 // VCPUs and setting IRQ lines.
 type VM struct {
-	// Memory represents a collection of physical memory slots for a VM.
-	Memory []*MemorySlot
-
 	// File descriptor of the created VM
 	fd uintptr
 
@@ -145,112 +165,142 @@ type VM struct {
 
 	// ioctl syscall implementation
 	ioctl ioctlFunc
-}
 
-// MemorySlotFlag is a flag which can be used with VM.AddMemorySlot.
-type MemorySlotFlag uint32
+	// Size in bytes of the kvm_run shared memory page mmapped by
+	// CreateVCPU, inherited from the Client that created this VM.
+	vcpuMmapSize int
 
-// Flags taken from KVM API documentation, Section 4.35.
-const (
-	MemoryLogDirtyPages MemorySlotFlag = 1
-	MemoryReadonly      MemorySlotFlag = 2
-)
+	// memSlots tracks live memory slots by slot number.
+	memSlots map[uint32]*MemorySlot
 
-// MemorySlot represents a virtual memory slot for a guest, and contains metadata
-// regarding the memory, as well as the actual backing memory slice.
-type MemorySlot struct {
-	Slot          uint32
-	Flags         uint32
-	GuestPhysAddr uint64
-	MemorySize    uint64
-	UserspaceAddr uint64
+	// memRanges tracks the same live memory slots sorted by
+	// GuestPhysAddr, for overlap detection.
+	memRanges []*MemorySlot
 
-	memory []byte
+	// bus routes PIO/MMIO exits decoded by (*VCPU).RunUntil to the
+	// devices registered via RegisterIODevice/RegisterMMIODevice. It is
+	// created lazily, since not every VM needs one.
+	bus *device.Bus
 }
 
-// kvmUserspaceMemoryRegion is analagous to kvm_userspace_memory_region, and is
-// used to create or modify a guest physical memory slot.
-type kvmUserspaceMemoryRegion struct {
-	slot          uint32
-	flags         uint32
-	guestPhysAddr uint64
-	memorySize    uint64
-	userspaceAddr uint64
+// ensureBus returns v.bus, creating it on first use.
+func (v *VM) ensureBus() *device.Bus {
+	if v.bus == nil {
+		v.bus = device.NewBus()
+	}
+
+	return v.bus
 }
 
-// AddMemorySlot allocates n bytes of virtual memory for a VM in a single slot,
-// using the host's physical memory.  Successive calls can be used to allocate
-// multiple slots of virtual memory.
-func (v *VM) AddMemorySlot(n uint64, flags MemorySlotFlag) error {
-	// Allocate a chunk of memory to be used with a guest
-	memory := make([]byte, n)
-
-	// Slot increments with MemorySlots added to the VM
-	slot := uint32(len(v.Memory))
-
-	// Physical address starts at 0, and increments by the offset and memory
-	// size of the previous slot
-	var guestPhysAddr uint64
-	if l := len(v.Memory); l > 0 {
-		guestPhysAddr = v.Memory[l-1].GuestPhysAddr + v.Memory[l-1].MemorySize
-	}
+// RegisterIODevice registers d to service guest port I/O in the range
+// [basePort, basePort+length), for dispatch by (*VCPU).RunUntil. See
+// device.Bus.RegisterIODevice.
+func (v *VM) RegisterIODevice(basePort, length uint16, d device.IODevice) error {
+	return v.ensureBus().RegisterIODevice(basePort, length, d)
+}
 
-	// TODO: optimize.
-	// "It is recommended that the lower 21 bits of guest_phys_addr and userspace_addr
-	// be identical.  This allows large pages in the guest to be backed by large
-	// pages in the host."
-
-	uFlags := uint32(flags)
-	uUserspaceAddr := uint64(uintptr(unsafe.Pointer(&memory[0])))
-
-	// Parameter struct to perform ioctl request
-	m := kvmUserspaceMemoryRegion{
-		slot:          slot,
-		flags:         uFlags,
-		guestPhysAddr: guestPhysAddr,
-		memorySize:    n,
-		userspaceAddr: uUserspaceAddr,
-	}
+// RegisterMMIODevice registers d to service guest memory-mapped I/O in
+// the range [baseAddr, baseAddr+length), for dispatch by
+// (*VCPU).RunUntil. See device.Bus.RegisterMMIODevice.
+func (v *VM) RegisterMMIODevice(baseAddr, length uint64, d device.MMIODevice) error {
+	return v.ensureBus().RegisterMMIODevice(baseAddr, length, d)
+}
 
-	// Attempt to add a memory slot
-	r, err := v.ioctl(v.fd, kvmSetUserMemoryRegion, uintptr(unsafe.Pointer(&m)))
+// AddVCPU adds n VCPUs to a virtual machine.
+func (v *VM) AddVCPU(n uint64) error {
+	max, err := v.maxVCPUs()
 	if err != nil {
 		return err
 	}
-	if r != 0 {
-		return errors.New("failed to add memory slot")
+
+	if n > uint64(max) {
+		return fmt.Errorf("%w: a maximum of %d VCPUs are supported", ErrTooManyVCPUS, max)
 	}
 
-	// Store for later use
-	v.Memory = append(v.Memory, &MemorySlot{
-		Slot:          slot,
-		Flags:         uFlags,
-		GuestPhysAddr: guestPhysAddr,
-		MemorySize:    n,
-		UserspaceAddr: uUserspaceAddr,
+	r, err := v.ioctl(v.fd, kvmCreateVCPU, uintptr(n))
+	if err != nil {
+		return err
+	}
 
-		// TODO: If we don't keep this here, will the guest's physical memory be
-		// garbage collected?
-		memory: memory,
-	})
+	v.vcpufd = r
 
 	return nil
 }
 
-// AddVCPU adds n VCPUs to a virtual machine.
-func (v *VM) AddVCPU(n uint64) error {
-	if n > kvmCapNrVCPUS {
-		return ErrTooManyVCPUS
+// maxVCPUs returns the maximum number of VCPUs the host supports for v,
+// preferring the more precise CapMaxVCPUs, falling back to CapNrVCPUs,
+// and finally to kvmDefaultNrVCPUs only if the host implements neither.
+// A CheckExtension error other than ErrCapabilityUnavailable is
+// propagated rather than treated as "unimplemented".
+func (v *VM) maxVCPUs() (int, error) {
+	n, err := v.CheckExtension(CapMaxVCPUs)
+	switch {
+	case err == nil:
+		return n, nil
+	case !errors.Is(err, ErrCapabilityUnavailable):
+		return 0, err
 	}
 
-	r, err := v.ioctl(v.fd, kvmCreateVCPU, uintptr(n))
+	n, err = v.CheckExtension(CapNrVCPUs)
+	switch {
+	case err == nil:
+		return n, nil
+	case !errors.Is(err, ErrCapabilityUnavailable):
+		return 0, err
+	}
+
+	return kvmDefaultNrVCPUs, nil
+}
+
+// MaxMemorySlots returns the maximum number of memory slots the host
+// supports for v, as reported by CapNrMemslots, falling back to
+// kvmDefaultNrMemslots only if the host does not implement that
+// capability. A CheckExtension error other than ErrCapabilityUnavailable
+// is propagated rather than treated as "unimplemented".
+func (v *VM) MaxMemorySlots() (uint32, error) {
+	n, err := v.CheckExtension(CapNrMemslots)
+	switch {
+	case err == nil:
+		return uint32(n), nil
+	case !errors.Is(err, ErrCapabilityUnavailable):
+		return 0, err
+	}
+
+	return kvmDefaultNrMemslots, nil
+}
+
+// CreateVCPU creates a single VCPU identified by id and mmaps its kvm_run
+// shared memory page, returning a VCPU that can be used to run guest code
+// via (*VCPU).Run and to read or write its register state. The caller
+// must call (*VCPU).Close once it is no longer needed.
+//
+// Unlike AddVCPU, CreateVCPU returns a handle to the created VCPU rather
+// than discarding all but the last one, and should be preferred by new
+// code.
+func (v *VM) CreateVCPU(id int) (*VCPU, error) {
+	fd, err := v.ioctl(v.fd, kvmCreateVCPU, uintptr(id))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	v.vcpufd = r
+	run, err := syscall.Mmap(
+		int(fd),
+		0,
+		v.vcpuMmapSize,
+		syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_SHARED,
+	)
+	if err != nil {
+		_ = syscall.Close(int(fd))
+		return nil, err
+	}
 
-	return nil
+	return &VCPU{
+		fd:    fd,
+		ioctl: v.ioctl,
+		run:   run,
+		vm:    v,
+	}, nil
 }
 
 // ioctlFunc is the signature for a function which can perform the ioctl syscall,
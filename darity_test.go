@@ -65,37 +65,38 @@ func TestVMAddMemorySlot(t *testing.T) {
 	var calls int
 
 	v := &VM{
-		Memory: make([]*MemorySlot, 0),
-
 		ioctl: func(fd uintptr, request int, argp uintptr) (uintptr, error) {
-			// Ensure correct request
-			if request != kvmSetUserMemoryRegion {
+			switch request {
+			case kvmCheckExtension:
+				return 0, nil
+			case kvmSetUserMemoryRegion:
+				// Retrieve parameter struct data
+				m := (*kvmUserspaceMemoryRegion)(unsafe.Pointer(argp))
+
+				// Verify memory slot increments with each call
+				if want, got := uint32(calls), m.slot; want != got {
+					t.Fatalf("[%02d] memory slot did not increment properly: %d != %d",
+						calls, want, got)
+				}
+
+				// Verify proper guest physical address offset
+				if want, got := (uint64(calls) * n), m.guestPhysAddr; want != got {
+					t.Fatalf("[%02d] incorrect guest physical address offset: %d != %d",
+						calls, want, got)
+				}
+
+				calls++
+				return 0, nil
+			default:
 				t.Fatalf("unexpected ioctl request number: %d", request)
+				return 0, nil
 			}
-
-			// Retrieve parameter struct data
-			m := (*kvmUserspaceMemoryRegion)(unsafe.Pointer(argp))
-
-			// Verify memory slot increments with each call
-			if want, got := uint32(calls), m.slot; want != got {
-				t.Fatalf("[%02d] memory slot did not increment properly: %d != %d",
-					calls, want, got)
-			}
-
-			// Verify proper guest physical address offset
-			if want, got := (uint64(calls) * n), m.guestPhysAddr; want != got {
-				t.Fatalf("[%02d] incorrect guest physical address offset: %d != %d",
-					calls, want, got)
-			}
-
-			calls++
-			return 0, nil
 		},
 	}
 
 	// Called twice to verify behaviors for both calls
 	for i := 0; i < 2; i++ {
-		if err := v.AddMemorySlot(n, flags); err != nil {
+		if _, err := v.AddMemorySlot(uint64(i)*n, n, flags); err != nil {
 			t.Fatalf("could not add memory slot: %q", err.Error())
 		}
 	}
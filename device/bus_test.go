@@ -0,0 +1,82 @@
+// +build linux
+
+package device
+
+import "testing"
+
+// fakeIODevice records the last access made to it.
+type fakeIODevice struct {
+	lastPort  uint16
+	lastWrite bool
+	lastByte  byte
+}
+
+func (d *fakeIODevice) Read(port uint16, data []byte) {
+	d.lastPort = port
+	d.lastWrite = false
+	data[0] = d.lastByte
+}
+
+func (d *fakeIODevice) Write(port uint16, data []byte) {
+	d.lastPort = port
+	d.lastWrite = true
+	d.lastByte = data[0]
+}
+
+// TestBusDispatchIO verifies that DispatchIO routes an access to the
+// device registered for that port, and reports false for an
+// unregistered port.
+func TestBusDispatchIO(t *testing.T) {
+	b := NewBus()
+	d := &fakeIODevice{}
+
+	if err := b.RegisterIODevice(0x3f8, 8, d); err != nil {
+		t.Fatalf("could not register IO device: %q", err.Error())
+	}
+
+	data := []byte{0x41}
+	if ok := b.DispatchIO(0x3f8, data, true); !ok {
+		t.Fatal("expected device to be found for registered port")
+	}
+	if !d.lastWrite || d.lastPort != 0x3f8 || d.lastByte != 0x41 {
+		t.Fatalf("unexpected dispatch result: %+v", d)
+	}
+
+	if ok := b.DispatchIO(0x2f8, data, true); ok {
+		t.Fatal("expected no device for unregistered port")
+	}
+}
+
+// TestBusDispatchIOHighPort verifies that a device registered near the
+// top of the port space, where base+length would overflow a uint16, can
+// still be dispatched to.
+func TestBusDispatchIOHighPort(t *testing.T) {
+	b := NewBus()
+	d := &fakeIODevice{}
+
+	if err := b.RegisterIODevice(0xfff8, 8, d); err != nil {
+		t.Fatalf("could not register IO device: %q", err.Error())
+	}
+
+	data := []byte{0x41}
+	if ok := b.DispatchIO(0xfff8, data, true); !ok {
+		t.Fatal("expected device to be found for registered port")
+	}
+	if !d.lastWrite || d.lastPort != 0xfff8 || d.lastByte != 0x41 {
+		t.Fatalf("unexpected dispatch result: %+v", d)
+	}
+}
+
+// TestBusRegisterIODeviceOverlap verifies that a second registration
+// overlapping an existing range is rejected.
+func TestBusRegisterIODeviceOverlap(t *testing.T) {
+	b := NewBus()
+
+	if err := b.RegisterIODevice(0x3f8, 8, &fakeIODevice{}); err != nil {
+		t.Fatalf("could not register first IO device: %q", err.Error())
+	}
+
+	if err := b.RegisterIODevice(0x3fa, 4, &fakeIODevice{}); err != ErrOverlap {
+		t.Fatalf("unexpected error registering overlapping device: %v != %v", ErrOverlap, err)
+	}
+}
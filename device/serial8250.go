@@ -0,0 +1,51 @@
+// +build linux
+
+package device
+
+import "io"
+
+// Serial8250 register offsets, relative to the port it is registered at.
+const (
+	serial8250THR = 0 // transmit holding register
+	serial8250LSR = 5 // line status register
+
+	serial8250LSRTxEmpty = 1 << 5
+	serial8250LSRTxIdle  = 1 << 6
+)
+
+// Serial8250 is a minimal reference IODevice implementing just enough of
+// the 8250 UART registers to let a guest print characters to stdout: a
+// write to the transmit holding register emits a byte, and the line
+// status register always reports the transmitter as idle. It is
+// typically registered at the legacy COM1 base of 0x3f8.
+type Serial8250 struct {
+	base uint16
+	w    io.Writer
+}
+
+// NewSerial8250 returns a Serial8250 that will be registered at base and
+// writes transmitted bytes to w.
+func NewSerial8250(base uint16, w io.Writer) *Serial8250 {
+	return &Serial8250{base: base, w: w}
+}
+
+// Read implements IODevice.
+func (s *Serial8250) Read(port uint16, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	switch port - s.base {
+	case serial8250LSR:
+		data[0] = serial8250LSRTxEmpty | serial8250LSRTxIdle
+	default:
+		data[0] = 0
+	}
+}
+
+// Write implements IODevice.
+func (s *Serial8250) Write(port uint16, data []byte) {
+	if port-s.base == serial8250THR && len(data) > 0 {
+		_, _ = s.w.Write(data[:1])
+	}
+}
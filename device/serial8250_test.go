@@ -0,0 +1,35 @@
+// +build linux
+
+package device
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestSerial8250Write verifies that a write to the transmit holding
+// register emits the byte to the configured writer.
+func TestSerial8250Write(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewSerial8250(0x3f8, &buf)
+
+	s.Write(0x3f8, []byte{'h'})
+	s.Write(0x3f8, []byte{'i'})
+
+	if want, got := "hi", buf.String(); want != got {
+		t.Fatalf("unexpected output: %q != %q", want, got)
+	}
+}
+
+// TestSerial8250ReadLSR verifies that reading the line status register
+// always reports the transmitter as idle.
+func TestSerial8250ReadLSR(t *testing.T) {
+	s := NewSerial8250(0x3f8, &bytes.Buffer{})
+
+	data := make([]byte, 1)
+	s.Read(0x3fd, data)
+
+	if want, got := byte(serial8250LSRTxEmpty|serial8250LSRTxIdle), data[0]; want != got {
+		t.Fatalf("unexpected LSR value: %#x != %#x", want, got)
+	}
+}
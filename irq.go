@@ -0,0 +1,154 @@
+// +build linux
+
+package darity
+
+import (
+	"os"
+	"unsafe"
+)
+
+// Constants taken from <linux/kvm.h>, so cgo is not necessary.
+const (
+	kvmCreateIRQChip = 44640
+	kvmSetTSSAddr    = 44615
+	kvmIRQLine       = 1074310753
+	kvmSignalMSI     = 1075883685
+	kvmSetIRQFD      = 1075883638
+	kvmSetIOEventFD  = 1077980793
+)
+
+// CreateIRQChip creates an in-kernel interrupt controller for v. It must
+// be called after CreateVM and before any VCPU is created, and is a
+// prerequisite for IRQLine, SignalMSI and IRQFD.
+func (v *VM) CreateIRQChip() error {
+	_, err := v.ioctl(v.fd, kvmCreateIRQChip, 0)
+	return err
+}
+
+// SetTSSAddr reserves addr as the guest physical address of a 3-page
+// region the in-kernel IRQ chip uses to emulate the x86 task state
+// segment. On Intel hosts it must be called before CreateIRQChip.
+func (v *VM) SetTSSAddr(addr uint32) error {
+	_, err := v.ioctl(v.fd, kvmSetTSSAddr, uintptr(addr))
+	return err
+}
+
+// kvmIRQLevel is analagous to kvm_irq_level, and is used to raise or
+// lower an in-kernel IRQ chip input line.
+type kvmIRQLevel struct {
+	irq   uint32
+	level uint32
+}
+
+// IRQLine raises (level true) or lowers (level false) irq, an input line
+// of the in-kernel IRQ chip created by CreateIRQChip.
+func (v *VM) IRQLine(irq uint32, level bool) error {
+	l := kvmIRQLevel{irq: irq}
+	if level {
+		l.level = 1
+	}
+
+	_, err := v.ioctl(v.fd, kvmIRQLine, uintptr(unsafe.Pointer(&l)))
+	return err
+}
+
+// kvmMSI is analagous to kvm_msi, and describes a message-signaled
+// interrupt to deliver directly to the in-kernel IRQ chip.
+type kvmMSI struct {
+	addressLo uint32
+	addressHi uint32
+	data      uint32
+	flags     uint32
+	devid     uint32
+
+	pad [12]uint8
+}
+
+// SignalMSI delivers the message-signaled interrupt described by addr and
+// data directly to the in-kernel IRQ chip, without going through
+// IRQLine.
+func (v *VM) SignalMSI(addr uint64, data uint32, flags uint32) error {
+	m := kvmMSI{
+		addressLo: uint32(addr),
+		addressHi: uint32(addr >> 32),
+		data:      data,
+		flags:     flags,
+	}
+
+	_, err := v.ioctl(v.fd, kvmSignalMSI, uintptr(unsafe.Pointer(&m)))
+	return err
+}
+
+// IRQFDFlag is a flag which can be used with VM.IRQFD.
+type IRQFDFlag uint32
+
+// Flags taken from KVM API documentation, Section 4.75.
+const (
+	IRQFDFlagDeassign IRQFDFlag = 1 << 0
+	IRQFDFlagResample IRQFDFlag = 1 << 1
+)
+
+// kvmIRQFD is analagous to kvm_irqfd.
+type kvmIRQFD struct {
+	fd         uint32
+	gsi        uint32
+	flags      uint32
+	resamplefd uint32
+
+	pad [16]uint8
+}
+
+// IRQFD registers fd with the in-kernel IRQ chip, such that any write to
+// it raises gsi without trapping into userspace. This lets a Go-side
+// device model notify the guest of an interrupt purely through the
+// kernel, instead of going through IRQLine on every event.
+func (v *VM) IRQFD(fd *os.File, gsi uint32, flags IRQFDFlag) error {
+	r := kvmIRQFD{
+		fd:    uint32(fd.Fd()),
+		gsi:   gsi,
+		flags: uint32(flags),
+	}
+
+	_, err := v.ioctl(v.fd, kvmSetIRQFD, uintptr(unsafe.Pointer(&r)))
+	return err
+}
+
+// IOEventFDFlag is a flag which can be used with VM.IOEventFD.
+type IOEventFDFlag uint32
+
+// Flags taken from KVM API documentation, Section 4.59.
+const (
+	IOEventFDFlagDatamatch IOEventFDFlag = 1 << 0
+	IOEventFDFlagPIO       IOEventFDFlag = 1 << 1
+	IOEventFDFlagDeassign  IOEventFDFlag = 1 << 2
+	IOEventFDFlagVirtioCCW IOEventFDFlag = 1 << 3
+)
+
+// kvmIOEventFD is analagous to kvm_ioeventfd.
+type kvmIOEventFD struct {
+	datamatch uint64
+	addr      uint64
+	length    uint32
+	fd        int32
+	flags     uint32
+
+	pad [36]uint8
+}
+
+// IOEventFD registers fd with the in-kernel PIO/MMIO dispatcher, such
+// that a guest access of length bytes at addr (matching datamatch, if
+// IOEventFDFlagDatamatch is set) signals fd without trapping into
+// userspace. This lets a Go-side device model be notified of writes
+// purely through the kernel, instead of handling every ExitIO/ExitMMIO.
+func (v *VM) IOEventFD(fd *os.File, addr uint64, length uint32, datamatch uint64, flags IOEventFDFlag) error {
+	e := kvmIOEventFD{
+		datamatch: datamatch,
+		addr:      addr,
+		length:    length,
+		fd:        int32(fd.Fd()),
+		flags:     uint32(flags),
+	}
+
+	_, err := v.ioctl(v.fd, kvmSetIOEventFD, uintptr(unsafe.Pointer(&e)))
+	return err
+}
@@ -0,0 +1,77 @@
+// +build linux
+
+package darity
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// TestKVMIRQLineRequestNumber verifies kvmIRQLine against an independent
+// encoding of KVM_IRQ_LINE = _IOW(KVMIO, 0x61, struct kvm_irq_level),
+// rather than comparing the constant to itself.
+func TestKVMIRQLineRequestNumber(t *testing.T) {
+	const (
+		kvmio           = 0xae
+		nr              = 0x61
+		kvmIRQLevelSize = 8 // struct kvm_irq_level { __u32 irq; __u32 level; }
+		iowDir          = 1
+	)
+
+	want := iowDir<<30 | kvmIRQLevelSize<<16 | kvmio<<8 | nr
+	if got := kvmIRQLine; want != got {
+		t.Fatalf("kvmIRQLine does not match KVM_IRQ_LINE: %#x != %#x", want, got)
+	}
+}
+
+// TestVMIRQLine verifies that IRQLine encodes irq and level into the
+// kvm_irq_level struct expected by KVM_IRQ_LINE.
+func TestVMIRQLine(t *testing.T) {
+	v := &VM{
+		ioctl: func(fd uintptr, request int, argp uintptr) (uintptr, error) {
+			if request != kvmIRQLine {
+				t.Fatalf("unexpected ioctl request number: %d", request)
+			}
+
+			l := (*kvmIRQLevel)(unsafe.Pointer(argp))
+			if want, got := uint32(5), l.irq; want != got {
+				t.Fatalf("unexpected irq: %d != %d", want, got)
+			}
+			if want, got := uint32(1), l.level; want != got {
+				t.Fatalf("unexpected level: %d != %d", want, got)
+			}
+
+			return 0, nil
+		},
+	}
+
+	if err := v.IRQLine(5, true); err != nil {
+		t.Fatalf("could not set IRQ line: %q", err.Error())
+	}
+}
+
+// TestVMCreateIRQChipAndSetTSSAddr verifies that both methods issue their
+// expected no-struct ioctls.
+func TestVMCreateIRQChipAndSetTSSAddr(t *testing.T) {
+	var lastRequest int
+	v := &VM{
+		ioctl: func(fd uintptr, request int, argp uintptr) (uintptr, error) {
+			lastRequest = request
+			return 0, nil
+		},
+	}
+
+	if err := v.SetTSSAddr(0xfffbd000); err != nil {
+		t.Fatalf("could not set TSS addr: %q", err.Error())
+	}
+	if want, got := kvmSetTSSAddr, lastRequest; want != got {
+		t.Fatalf("unexpected ioctl request number: %d != %d", want, got)
+	}
+
+	if err := v.CreateIRQChip(); err != nil {
+		t.Fatalf("could not create IRQ chip: %q", err.Error())
+	}
+	if want, got := kvmCreateIRQChip, lastRequest; want != got {
+		t.Fatalf("unexpected ioctl request number: %d != %d", want, got)
+	}
+}
@@ -0,0 +1,252 @@
+// +build linux
+
+package darity
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"syscall"
+	"unsafe"
+)
+
+// Constants taken from <linux/kvm.h>, so cgo is not necessary.
+const (
+	kvmSetUserMemoryRegion = 1075883590
+	kvmGetDirtyLog         = 1074835010
+
+	// kvmPageSize is the host page size KVM uses when sizing the dirty
+	// bitmap returned by GetDirtyLog.
+	kvmPageSize = 4096
+)
+
+// MemorySlotFlag is a flag which can be used with VM.AddMemorySlot.
+type MemorySlotFlag uint32
+
+// Flags taken from KVM API documentation, Section 4.35.
+const (
+	MemoryLogDirtyPages MemorySlotFlag = 1
+	MemoryReadonly      MemorySlotFlag = 2
+)
+
+// MemorySlot represents a virtual memory slot for a guest, and contains metadata
+// regarding the memory, as well as the actual backing memory slice.
+type MemorySlot struct {
+	Slot          uint32
+	Flags         uint32
+	GuestPhysAddr uint64
+	MemorySize    uint64
+	UserspaceAddr uint64
+
+	memory []byte
+}
+
+// kvmUserspaceMemoryRegion is analagous to kvm_userspace_memory_region, and is
+// used to create, modify, or delete a guest physical memory slot.
+type kvmUserspaceMemoryRegion struct {
+	slot          uint32
+	flags         uint32
+	guestPhysAddr uint64
+	memorySize    uint64
+	userspaceAddr uint64
+}
+
+// kvmDirtyLog is analagous to kvm_dirty_log, and is used to retrieve the
+// bitmap of guest pages written to since a slot was created, or since its
+// dirty log was last retrieved.
+type kvmDirtyLog struct {
+	slot        uint32
+	padding     uint32
+	dirtyBitmap unsafe.Pointer
+}
+
+// ErrMemoryOverlap is returned by AddMemorySlot when the requested guest
+// physical address range overlaps an existing live slot.
+var ErrMemoryOverlap = errors.New("memory slot overlaps an existing slot")
+
+// AddMemorySlot allocates n bytes of virtual memory for a VM, backing the
+// guest physical address range [guestPhysAddr, guestPhysAddr+n) using the
+// host's physical memory. It rejects ranges that overlap an existing live
+// slot with ErrMemoryOverlap, and assigns the lowest slot number not
+// currently in use, bounded by VM.MaxMemorySlots.
+func (v *VM) AddMemorySlot(guestPhysAddr, n uint64, flags MemorySlotFlag) (*MemorySlot, error) {
+	if v.overlapsExistingSlot(guestPhysAddr, n) {
+		return nil, ErrMemoryOverlap
+	}
+
+	slot, err := v.nextMemorySlot()
+	if err != nil {
+		return nil, err
+	}
+
+	// Back the slot with an anonymous mapping rather than make([]byte, n)
+	// so that large guest memory sizes don't force early commit of that
+	// much resident memory.
+	memory, err := syscall.Mmap(
+		-1,
+		0,
+		int(n),
+		syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS|syscall.MAP_NORESERVE,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// TODO: optimize.
+	// "It is recommended that the lower 21 bits of guest_phys_addr and userspace_addr
+	// be identical.  This allows large pages in the guest to be backed by large
+	// pages in the host."
+
+	m := &MemorySlot{
+		Slot:          slot,
+		Flags:         uint32(flags),
+		GuestPhysAddr: guestPhysAddr,
+		MemorySize:    n,
+		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&memory[0]))),
+
+		memory: memory,
+	}
+
+	if err := v.setUserMemoryRegion(m); err != nil {
+		_ = syscall.Munmap(memory)
+		return nil, err
+	}
+
+	v.trackMemorySlot(m)
+
+	return m, nil
+}
+
+// RemoveMemorySlot removes slot, re-issuing KVM_SET_USER_MEMORY_REGION
+// with a memory size of zero (the KVM convention for deleting a slot),
+// and releases its backing memory.
+func (v *VM) RemoveMemorySlot(slot uint32) error {
+	m, ok := v.memSlots[slot]
+	if !ok {
+		return fmt.Errorf("memory slot %d does not exist", slot)
+	}
+
+	deleted := *m
+	deleted.MemorySize = 0
+
+	if err := v.setUserMemoryRegion(&deleted); err != nil {
+		return err
+	}
+
+	v.untrackMemorySlot(slot)
+
+	return syscall.Munmap(m.memory)
+}
+
+// GetDirtyLog returns the dirty page bitmap for slot, which must have
+// been created with MemoryLogDirtyPages. Each set bit corresponds to one
+// guest page written to since the slot was created, or since the log was
+// last retrieved.
+func (v *VM) GetDirtyLog(slot uint32) ([]byte, error) {
+	m, ok := v.memSlots[slot]
+	if !ok {
+		return nil, fmt.Errorf("memory slot %d does not exist", slot)
+	}
+	if MemorySlotFlag(m.Flags)&MemoryLogDirtyPages == 0 {
+		return nil, fmt.Errorf("memory slot %d was not created with MemoryLogDirtyPages", slot)
+	}
+
+	pages := (m.MemorySize + kvmPageSize - 1) / kvmPageSize
+	bitmap := make([]byte, (pages+7)/8)
+
+	log := kvmDirtyLog{
+		slot:        slot,
+		dirtyBitmap: unsafe.Pointer(&bitmap[0]),
+	}
+
+	if _, err := v.ioctl(v.fd, kvmGetDirtyLog, uintptr(unsafe.Pointer(&log))); err != nil {
+		return nil, err
+	}
+
+	return bitmap, nil
+}
+
+// setUserMemoryRegion issues KVM_SET_USER_MEMORY_REGION for m, used to
+// create, modify, or (with a zero MemorySize) delete a slot.
+func (v *VM) setUserMemoryRegion(m *MemorySlot) error {
+	region := kvmUserspaceMemoryRegion{
+		slot:          m.Slot,
+		flags:         m.Flags,
+		guestPhysAddr: m.GuestPhysAddr,
+		memorySize:    m.MemorySize,
+		userspaceAddr: m.UserspaceAddr,
+	}
+
+	r, err := v.ioctl(v.fd, kvmSetUserMemoryRegion, uintptr(unsafe.Pointer(&region)))
+	if err != nil {
+		return err
+	}
+	if r != 0 {
+		return errors.New("failed to set memory region")
+	}
+
+	return nil
+}
+
+// overlapsExistingSlot reports whether [addr, addr+n) intersects any
+// existing live slot's guest physical address range.
+func (v *VM) overlapsExistingSlot(addr, n uint64) bool {
+	end := addr + n
+
+	i := sort.Search(len(v.memRanges), func(i int) bool {
+		r := v.memRanges[i]
+		return r.GuestPhysAddr+r.MemorySize > addr
+	})
+
+	return i < len(v.memRanges) && v.memRanges[i].GuestPhysAddr < end
+}
+
+// nextMemorySlot returns the lowest slot number not currently in use,
+// bounded by VM.MaxMemorySlots.
+func (v *VM) nextMemorySlot() (uint32, error) {
+	max, err := v.MaxMemorySlots()
+	if err != nil {
+		return 0, err
+	}
+
+	for slot := uint32(0); slot < max; slot++ {
+		if _, ok := v.memSlots[slot]; !ok {
+			return slot, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no memory slots available: host supports a maximum of %d", max)
+}
+
+// trackMemorySlot records m in the slot table and the GuestPhysAddr-sorted
+// range index used by overlapsExistingSlot.
+func (v *VM) trackMemorySlot(m *MemorySlot) {
+	if v.memSlots == nil {
+		v.memSlots = make(map[uint32]*MemorySlot)
+	}
+	v.memSlots[m.Slot] = m
+
+	i := sort.Search(len(v.memRanges), func(i int) bool {
+		return v.memRanges[i].GuestPhysAddr >= m.GuestPhysAddr
+	})
+	v.memRanges = append(v.memRanges, nil)
+	copy(v.memRanges[i+1:], v.memRanges[i:])
+	v.memRanges[i] = m
+}
+
+// untrackMemorySlot removes slot from the slot table and range index.
+func (v *VM) untrackMemorySlot(slot uint32) {
+	m, ok := v.memSlots[slot]
+	if !ok {
+		return
+	}
+	delete(v.memSlots, slot)
+
+	for i, r := range v.memRanges {
+		if r == m {
+			v.memRanges = append(v.memRanges[:i], v.memRanges[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// +build linux
+
+package darity
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// noopMemoryIoctl returns an ioctlFunc that answers kvmCheckExtension with
+// "unavailable" and kvmSetUserMemoryRegion with success, which is enough
+// to exercise the slot bookkeeping in this file without a real KVM fd.
+func noopMemoryIoctl(t *testing.T) ioctlFunc {
+	return func(fd uintptr, request int, argp uintptr) (uintptr, error) {
+		switch request {
+		case kvmCheckExtension, kvmSetUserMemoryRegion:
+			return 0, nil
+		default:
+			t.Fatalf("unexpected ioctl request number: %d", request)
+			return 0, nil
+		}
+	}
+}
+
+// TestVMAddMemorySlotOverlap verifies that AddMemorySlot rejects a range
+// overlapping an existing live slot.
+func TestVMAddMemorySlotOverlap(t *testing.T) {
+	v := &VM{ioctl: noopMemoryIoctl(t)}
+
+	if _, err := v.AddMemorySlot(0, 4096, 0); err != nil {
+		t.Fatalf("could not add first memory slot: %q", err.Error())
+	}
+
+	if _, err := v.AddMemorySlot(2048, 4096, 0); err != ErrMemoryOverlap {
+		t.Fatalf("unexpected error adding overlapping slot: %v != %v", ErrMemoryOverlap, err)
+	}
+
+	// A range directly after the first slot, touching but not overlapping
+	// it, should still succeed.
+	if _, err := v.AddMemorySlot(4096, 4096, 0); err != nil {
+		t.Fatalf("could not add adjacent memory slot: %q", err.Error())
+	}
+}
+
+// TestVMRemoveMemorySlot verifies that RemoveMemorySlot frees a slot
+// number for reuse and drops it from overlap detection.
+func TestVMRemoveMemorySlot(t *testing.T) {
+	v := &VM{ioctl: noopMemoryIoctl(t)}
+
+	m, err := v.AddMemorySlot(0, 4096, 0)
+	if err != nil {
+		t.Fatalf("could not add memory slot: %q", err.Error())
+	}
+
+	if err := v.RemoveMemorySlot(m.Slot); err != nil {
+		t.Fatalf("could not remove memory slot: %q", err.Error())
+	}
+
+	if _, ok := v.memSlots[m.Slot]; ok {
+		t.Fatal("removed memory slot is still tracked")
+	}
+
+	// The freed slot number and address range should both be reusable.
+	if _, err := v.AddMemorySlot(0, 4096, 0); err != nil {
+		t.Fatalf("could not reuse freed memory slot: %q", err.Error())
+	}
+}
+
+// TestVMGetDirtyLogRequiresFlag verifies that GetDirtyLog refuses to
+// operate on a slot that wasn't created with MemoryLogDirtyPages.
+func TestVMGetDirtyLogRequiresFlag(t *testing.T) {
+	v := &VM{ioctl: noopMemoryIoctl(t)}
+
+	m, err := v.AddMemorySlot(0, 4096, 0)
+	if err != nil {
+		t.Fatalf("could not add memory slot: %q", err.Error())
+	}
+
+	if _, err := v.GetDirtyLog(m.Slot); err == nil {
+		t.Fatal("expected error retrieving dirty log for non-logging slot, got none")
+	}
+}
+
+// TestVMGetDirtyLogReturnsBitmap verifies that GetDirtyLog sizes its
+// bitmap from the slot's page count, populates kvmDirtyLog correctly,
+// and returns the bitmap written through dirtyBitmap by the ioctl.
+func TestVMGetDirtyLogReturnsBitmap(t *testing.T) {
+	const slotSize = 8 * kvmPageSize // 8 pages -> a 1-byte bitmap
+	const wantByte = 0x5a
+
+	v := &VM{
+		ioctl: func(fd uintptr, request int, argp uintptr) (uintptr, error) {
+			switch request {
+			case kvmCheckExtension, kvmSetUserMemoryRegion:
+				return 0, nil
+			case kvmGetDirtyLog:
+				log := (*kvmDirtyLog)(unsafe.Pointer(argp))
+				if want, got := uint32(0), log.slot; want != got {
+					t.Fatalf("unexpected slot in kvmDirtyLog: %d != %d", want, got)
+				}
+				*(*byte)(log.dirtyBitmap) = wantByte
+				return 0, nil
+			default:
+				t.Fatalf("unexpected ioctl request number: %d", request)
+				return 0, nil
+			}
+		},
+	}
+
+	m, err := v.AddMemorySlot(0, slotSize, MemoryLogDirtyPages)
+	if err != nil {
+		t.Fatalf("could not add memory slot: %q", err.Error())
+	}
+
+	bitmap, err := v.GetDirtyLog(m.Slot)
+	if err != nil {
+		t.Fatalf("could not get dirty log: %q", err.Error())
+	}
+
+	if want, got := 1, len(bitmap); want != got {
+		t.Fatalf("unexpected bitmap length: %d != %d", want, got)
+	}
+	if want, got := byte(wantByte), bitmap[0]; want != got {
+		t.Fatalf("unexpected bitmap contents: %#x != %#x", want, got)
+	}
+}
@@ -0,0 +1,218 @@
+// +build linux
+
+package darity
+
+import "unsafe"
+
+// Constants taken from <linux/kvm.h>, so cgo is not necessary.
+const (
+	kvmGetRegs  = 2156965505
+	kvmSetRegs  = 1083223682
+	kvmGetSregs = 2167975555
+	kvmSetSregs = 1094233732
+	kvmGetFPU   = 2174791308
+	kvmSetFPU   = 1101049485
+
+	kvmSetCPUID2         = 1074310800
+	kvmGetSupportedCPUID = 3221794309
+
+	// kvmMaxCPUIDEntries bounds the number of kvm_cpuid_entry2 slots
+	// allocated when querying or setting CPUID leaves. It comfortably
+	// exceeds the number of leaves reported by real hardware.
+	kvmMaxCPUIDEntries = 80
+)
+
+// Regs mirrors kvm_regs, the general purpose register state of a VCPU,
+// as used by GetRegs and SetRegs.
+type Regs struct {
+	RAX, RBX, RCX, RDX uint64
+	RSI, RDI, RSP, RBP uint64
+	R8, R9, R10, R11   uint64
+	R12, R13, R14, R15 uint64
+	RIP, RFLAGS        uint64
+}
+
+// GetRegs returns the current general purpose register state of vc.
+func (vc *VCPU) GetRegs() (*Regs, error) {
+	var r Regs
+	if _, err := vc.ioctl(vc.fd, kvmGetRegs, uintptr(unsafe.Pointer(&r))); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// SetRegs writes r as the general purpose register state of vc.
+func (vc *VCPU) SetRegs(r *Regs) error {
+	_, err := vc.ioctl(vc.fd, kvmSetRegs, uintptr(unsafe.Pointer(r)))
+	return err
+}
+
+// Segment mirrors kvm_segment, describing one x86 segment register
+// (or task/LDT selector) as used by Sregs.
+type Segment struct {
+	Base     uint64
+	Limit    uint32
+	Selector uint16
+	Type     uint8
+	Present  uint8
+	DPL      uint8
+	DB       uint8
+	S        uint8
+	L        uint8
+	G        uint8
+	AVL      uint8
+	Unusable uint8
+
+	_ uint8 // padding
+}
+
+// DTable mirrors kvm_dtable, describing the base/limit pair of the GDT
+// or IDT, as used by Sregs.
+type DTable struct {
+	Base  uint64
+	Limit uint16
+
+	_ [3]uint16 // padding
+}
+
+// Sregs mirrors kvm_sregs, the system/special register state of a VCPU,
+// as used by GetSregs and SetSregs.
+type Sregs struct {
+	CS, DS, ES, FS, GS, SS Segment
+	TR, LDT                Segment
+
+	GDT, IDT DTable
+
+	CR0, CR2, CR3, CR4, CR8 uint64
+	EFER                    uint64
+	ApicBase                uint64
+
+	// InterruptBitmap tracks pending interrupts when the in-kernel
+	// local APIC is not in use.
+	InterruptBitmap [4]uint64
+}
+
+// GetSregs returns the current system register state of vc.
+func (vc *VCPU) GetSregs() (*Sregs, error) {
+	var s Sregs
+	if _, err := vc.ioctl(vc.fd, kvmGetSregs, uintptr(unsafe.Pointer(&s))); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SetSregs writes s as the system register state of vc.
+func (vc *VCPU) SetSregs(s *Sregs) error {
+	_, err := vc.ioctl(vc.fd, kvmSetSregs, uintptr(unsafe.Pointer(s)))
+	return err
+}
+
+// FPU mirrors kvm_fpu, the x87/SSE floating point register state of a
+// VCPU, as used by GetFPU and SetFPU.
+type FPU struct {
+	FPR  [8][16]uint8
+	FCW  uint16
+	FSW  uint16
+	FTWX uint8
+
+	_ uint8 // pad1
+
+	LastOpcode uint16
+	LastIP     uint64
+	LastDP     uint64
+	XMM        [16][16]uint8
+	MXCSR      uint32
+
+	_ uint32 // pad2
+}
+
+// GetFPU returns the current floating point register state of vc.
+func (vc *VCPU) GetFPU() (*FPU, error) {
+	var f FPU
+	if _, err := vc.ioctl(vc.fd, kvmGetFPU, uintptr(unsafe.Pointer(&f))); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// SetFPU writes f as the floating point register state of vc.
+func (vc *VCPU) SetFPU(f *FPU) error {
+	_, err := vc.ioctl(vc.fd, kvmSetFPU, uintptr(unsafe.Pointer(f)))
+	return err
+}
+
+// CPUIDEntry2 mirrors kvm_cpuid_entry2, describing a single CPUID leaf
+// as reported by Client.SupportedCPUID or configured via
+// (*VCPU).SetCPUID2.
+type CPUIDEntry2 struct {
+	Function uint32
+	Index    uint32
+	Flags    uint32
+	EAX      uint32
+	EBX      uint32
+	ECX      uint32
+	EDX      uint32
+
+	_ [3]uint32 // padding
+}
+
+// kvmCPUID2Header mirrors the fixed portion of kvm_cpuid2, which is
+// followed by a flexible array of kvm_cpuid_entry2 entries. darity
+// allocates a backing byte slice sized for the entries up front (the
+// "incomplete array" pattern used throughout the KVM API) rather than
+// modelling the flexible array directly, since Go has no equivalent.
+type kvmCPUID2Header struct {
+	nent    uint32
+	padding uint32
+}
+
+// newCPUID2Buffer allocates a kvm_cpuid2-shaped buffer with room for n
+// entries and sets its nent field, for use with KVM_SET_CPUID2 or
+// KVM_GET_SUPPORTED_CPUID.
+func newCPUID2Buffer(n int) []byte {
+	headerSize := int(unsafe.Sizeof(kvmCPUID2Header{}))
+	entrySize := int(unsafe.Sizeof(CPUIDEntry2{}))
+
+	buf := make([]byte, headerSize+n*entrySize)
+
+	h := (*kvmCPUID2Header)(unsafe.Pointer(&buf[0]))
+	h.nent = uint32(n)
+
+	return buf
+}
+
+// cpuid2Entries returns the CPUIDEntry2 slice backed by buf, sized
+// according to its nent field.
+func cpuid2Entries(buf []byte) []CPUIDEntry2 {
+	headerSize := int(unsafe.Sizeof(kvmCPUID2Header{}))
+	h := (*kvmCPUID2Header)(unsafe.Pointer(&buf[0]))
+	entries := (*CPUIDEntry2)(unsafe.Pointer(&buf[headerSize]))
+
+	return unsafe.Slice(entries, int(h.nent))
+}
+
+// SupportedCPUID returns the set of CPUID leaves KVM can emulate or pass
+// through to a guest on this host, for use with (*VCPU).SetCPUID2.
+func (c *Client) SupportedCPUID() ([]CPUIDEntry2, error) {
+	buf := newCPUID2Buffer(kvmMaxCPUIDEntries)
+
+	if _, err := c.ioctl(c.kvm.Fd(), kvmGetSupportedCPUID, uintptr(unsafe.Pointer(&buf[0]))); err != nil {
+		return nil, err
+	}
+
+	entries := cpuid2Entries(buf)
+	out := make([]CPUIDEntry2, len(entries))
+	copy(out, entries)
+
+	return out, nil
+}
+
+// SetCPUID2 configures the CPUID leaves visible to the guest running on
+// vc, typically a subset of Client.SupportedCPUID.
+func (vc *VCPU) SetCPUID2(entries []CPUIDEntry2) error {
+	buf := newCPUID2Buffer(len(entries))
+	copy(cpuid2Entries(buf), entries)
+
+	_, err := vc.ioctl(vc.fd, kvmSetCPUID2, uintptr(unsafe.Pointer(&buf[0])))
+	return err
+}
@@ -0,0 +1,84 @@
+// +build linux
+
+package darity
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// TestRegsSize verifies that Regs mirrors the 144-byte layout of
+// kvm_regs (18 little-endian u64 fields), so the raw ioctl round-trips
+// correctly.
+func TestRegsSize(t *testing.T) {
+	if want, got := uintptr(144), unsafe.Sizeof(Regs{}); want != got {
+		t.Fatalf("unexpected Regs size: %d != %d", want, got)
+	}
+}
+
+// TestSregsSize verifies that Sregs mirrors the 312-byte layout of
+// kvm_sregs.
+func TestSregsSize(t *testing.T) {
+	if want, got := uintptr(312), unsafe.Sizeof(Sregs{}); want != got {
+		t.Fatalf("unexpected Sregs size: %d != %d", want, got)
+	}
+}
+
+// TestVCPUGetSetRegs verifies that GetRegs and SetRegs issue the
+// expected ioctls and marshal a Regs value through the raw pointer.
+func TestVCPUGetSetRegs(t *testing.T) {
+	want := &Regs{RAX: 1, RIP: 0x7c00, RFLAGS: 0x2}
+
+	vc := &VCPU{
+		ioctl: func(fd uintptr, request int, argp uintptr) (uintptr, error) {
+			switch request {
+			case kvmSetRegs:
+				got := (*Regs)(unsafe.Pointer(argp))
+				if *got != *want {
+					t.Fatalf("unexpected regs written: %+v != %+v", want, got)
+				}
+			case kvmGetRegs:
+				*(*Regs)(unsafe.Pointer(argp)) = *want
+			default:
+				t.Fatalf("unexpected ioctl request number: %d", request)
+			}
+			return 0, nil
+		},
+	}
+
+	if err := vc.SetRegs(want); err != nil {
+		t.Fatalf("could not set regs: %q", err.Error())
+	}
+
+	got, err := vc.GetRegs()
+	if err != nil {
+		t.Fatalf("could not get regs: %q", err.Error())
+	}
+
+	if *got != *want {
+		t.Fatalf("unexpected regs: %+v != %+v", want, got)
+	}
+}
+
+// TestCPUID2Buffer verifies that newCPUID2Buffer and cpuid2Entries round
+// trip entries through the kvm_cpuid2 "incomplete array" layout.
+func TestCPUID2Buffer(t *testing.T) {
+	want := []CPUIDEntry2{
+		{Function: 0x0, EAX: 0x16},
+		{Function: 0x1, ECX: 0xbfebfbff},
+	}
+
+	buf := newCPUID2Buffer(len(want))
+	copy(cpuid2Entries(buf), want)
+
+	got := cpuid2Entries(buf)
+	if len(got) != len(want) {
+		t.Fatalf("unexpected entry count: %d != %d", len(want), len(got))
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("[%d] unexpected entry: %+v != %+v", i, want[i], got[i])
+		}
+	}
+}
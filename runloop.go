@@ -0,0 +1,89 @@
+// +build linux
+
+package darity
+
+import (
+	"context"
+	"fmt"
+)
+
+// BUG(kitschysynq): (*VCPU).RunUntil cannot interrupt a VCPU already
+// blocked inside KVM_RUN; a canceled context only takes effect between
+// calls to Run. A guest that runs indefinitely without a trapping IO or
+// MMIO access will hang RunUntil regardless of cancellation. Real
+// interruption requires unblocking and delivering a signal (e.g.
+// SIGUSR1) to the blocked thread via KVM_SET_SIGNAL_MASK and a
+// targeted kill, which this package does not yet implement.
+
+// RunUntil repeatedly calls Run, dispatching ExitIO and ExitMMIO exits to
+// the devices registered on the owning VM via RegisterIODevice and
+// RegisterMMIODevice, until the guest halts, shuts down, fails to enter,
+// or ctx is canceled.
+//
+// WARNING: ctx cancellation is NOT guaranteed to make RunUntil return.
+// Cancellation only sets kvm_run.immediate_exit, which KVM consults
+// between calls to Run, so it reliably stops a call that hasn't yet
+// entered guest mode. It cannot interrupt a call already inside the
+// guest: a guest that doesn't periodically trap out via IO/MMIO will
+// hang RunUntil for as long as it keeps running, canceled ctx or not.
+// See BUG below.
+func (vc *VCPU) RunUntil(ctx context.Context) error {
+	// Clear immediate_exit left over from a prior canceled RunUntil on
+	// this VCPU; otherwise every KVM_RUN here would return immediately
+	// without ever entering guest mode.
+	vc.clearImmediateExit()
+
+	// stop tells the watcher goroutine below to give up waiting on ctx;
+	// watcherDone is closed by that goroutine once it has actually
+	// returned. Waiting on watcherDone before clearing immediate_exit
+	// below closes a race where ctx is canceled at roughly the same
+	// moment the guest exits naturally: without the join, the watcher
+	// could still call requestImmediateExit after RunUntil has already
+	// returned, leaving immediate_exit stuck set for the next call.
+	stop := make(chan struct{})
+	watcherDone := make(chan struct{})
+	defer func() {
+		close(stop)
+		<-watcherDone
+		vc.clearImmediateExit()
+	}()
+
+	go func() {
+		defer close(watcherDone)
+		select {
+		case <-ctx.Done():
+			vc.requestImmediateExit()
+		case <-stop:
+		}
+	}()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		exit, err := vc.Run()
+		if err != nil {
+			return err
+		}
+
+		switch e := exit.(type) {
+		case ExitHLT:
+			return nil
+		case ExitShutdown:
+			return nil
+		case ExitFailEntry:
+			return fmt.Errorf("vcpu failed to enter: %+v", e)
+		case ExitInternalError:
+			return fmt.Errorf("vcpu internal error: %+v", e)
+		case ExitIO:
+			if vc.vm != nil && vc.vm.bus != nil {
+				vc.vm.bus.DispatchIO(e.Port, e.Data, e.Direction == IODirectionOut)
+			}
+		case ExitMMIO:
+			if vc.vm != nil && vc.vm.bus != nil {
+				vc.vm.bus.DispatchMMIO(e.PhysAddr, e.Data, e.IsWrite)
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// +build linux
+
+package darity
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/kitschysynq/darity/device"
+)
+
+// fakeIODevice records the last byte written to it via an OUT.
+type fakeIODevice struct {
+	lastByte byte
+}
+
+func (d *fakeIODevice) Read(port uint16, data []byte) {}
+func (d *fakeIODevice) Write(port uint16, data []byte) {
+	if len(data) > 0 {
+		d.lastByte = data[0]
+	}
+}
+
+// TestVCPURunUntilDispatchesIOThenHalts verifies that RunUntil dispatches
+// an ExitIO to the registered IODevice before returning cleanly on
+// ExitHLT.
+func TestVCPURunUntilDispatchesIOThenHalts(t *testing.T) {
+	run := newTestRunPage()
+	dev := &fakeIODevice{}
+
+	vm := &VM{}
+	if err := vm.RegisterIODevice(0x3f8, 1, dev); err != nil {
+		t.Fatalf("could not register IO device: %q", err.Error())
+	}
+
+	const dataOffset = 48
+	calls := 0
+
+	vc := &VCPU{
+		run: run,
+		vm:  vm,
+		ioctl: func(fd uintptr, request int, argp uintptr) (uintptr, error) {
+			if request != kvmRun {
+				t.Fatalf("unexpected ioctl request number: %d", request)
+			}
+
+			calls++
+			if calls == 1 {
+				binary.LittleEndian.PutUint32(run[kvmRunExitReasonOffset:], kvmExitIO)
+				u := kvmRunExitUnionOffset
+				run[u+kvmRunIODirectionOffset] = byte(IODirectionOut)
+				run[u+kvmRunIOSizeOffset] = 1
+				binary.LittleEndian.PutUint16(run[u+kvmRunIOPortOffset:], 0x3f8)
+				binary.LittleEndian.PutUint32(run[u+kvmRunIOCountOffset:], 1)
+				binary.LittleEndian.PutUint64(run[u+kvmRunIODataOffset:], dataOffset)
+				run[dataOffset] = 'X'
+			} else {
+				binary.LittleEndian.PutUint32(run[kvmRunExitReasonOffset:], kvmExitHLT)
+			}
+
+			return 0, nil
+		},
+	}
+
+	if err := vc.RunUntil(context.Background()); err != nil {
+		t.Fatalf("RunUntil returned an error: %q", err.Error())
+	}
+
+	if want, got := 2, calls; want != got {
+		t.Fatalf("unexpected number of Run calls: %d != %d", want, got)
+	}
+	if want, got := byte('X'), dev.lastByte; want != got {
+		t.Fatalf("IO device did not observe expected write: %q != %q", want, got)
+	}
+}
+
+// TestVCPURunUntilCanceled verifies that RunUntil returns ctx.Err() once
+// the context passed to it is canceled.
+func TestVCPURunUntilCanceled(t *testing.T) {
+	run := newTestRunPage()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	vc := &VCPU{
+		run: run,
+		ioctl: func(fd uintptr, request int, argp uintptr) (uintptr, error) {
+			t.Fatal("Run should not be called once ctx is already canceled")
+			return 0, nil
+		},
+	}
+
+	if err := vc.RunUntil(ctx); err != ctx.Err() {
+		t.Fatalf("unexpected error: %v != %v", ctx.Err(), err)
+	}
+}
+
+// TestVCPURunUntilCanceledAtHalt exercises ctx being canceled at roughly
+// the same moment the guest exits naturally via HLT, so the watcher
+// goroutine's call to requestImmediateExit can race with RunUntil
+// returning. Run with -race, this must leave immediate_exit cleared and
+// must not report a data race.
+func TestVCPURunUntilCanceledAtHalt(t *testing.T) {
+	run := newTestRunPage()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	vc := &VCPU{
+		run: run,
+		ioctl: func(fd uintptr, request int, argp uintptr) (uintptr, error) {
+			cancel()
+			binary.LittleEndian.PutUint32(run[kvmRunExitReasonOffset:], kvmExitHLT)
+			return 0, nil
+		},
+	}
+
+	if err := vc.RunUntil(ctx); err != nil {
+		t.Fatalf("RunUntil returned an error: %q", err.Error())
+	}
+
+	if got := run[kvmRunImmediateExitOffset]; got != 0 {
+		t.Fatalf("immediate_exit left set after RunUntil returned: %d", got)
+	}
+}
+
+var _ device.IODevice = (*fakeIODevice)(nil)
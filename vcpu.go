@@ -0,0 +1,293 @@
+// +build linux
+
+package darity
+
+import (
+	"encoding/binary"
+	"syscall"
+)
+
+// Constants taken from <linux/kvm.h>, describing the layout of the
+// kvm_run structure mmapped by VM.CreateVCPU. They are recorded as byte
+// offsets here, rather than decoded via cgo, so that darity stays
+// cgo-free.
+const (
+	// kvmRunExitReasonOffset is the offset of kvm_run.exit_reason on
+	// x86_64, following the leading request_interrupt_window,
+	// immediate_exit and padding1[6] fields:
+	//
+	//   __u8  request_interrupt_window;
+	//   __u8  immediate_exit;
+	//   __u8  padding1[6];
+	//   __u32 exit_reason;
+	kvmRunExitReasonOffset = 8
+
+	// kvmRunExitUnionOffset is the offset of the exit_reason-specific
+	// union, following exit_reason and the
+	// ready_for_interrupt_injection, if_flag, flags, cr8 and apic_base
+	// fields that precede it.
+	kvmRunExitUnionOffset = 32
+
+	// kvmRunImmediateExitOffset is the offset of kvm_run.immediate_exit,
+	// the second byte of the kvm_run page. Setting it asks KVM to return
+	// from KVM_RUN as soon as possible instead of entering guest mode,
+	// without needing a real signal to interrupt the ioctl.
+	kvmRunImmediateExitOffset = 1
+)
+
+// Offsets of the fields used by each supported exit reason, relative to
+// kvmRunExitUnionOffset.
+const (
+	// struct {
+	//   __u8  direction;
+	//   __u8  size;
+	//   __u16 port;
+	//   __u32 count;
+	//   __u64 data_offset;
+	// } io;
+	kvmRunIODirectionOffset = 0
+	kvmRunIOSizeOffset      = 1
+	kvmRunIOPortOffset      = 2
+	kvmRunIOCountOffset     = 4
+	kvmRunIODataOffset      = 8
+
+	// struct {
+	//   __u64 phys_addr;
+	//   __u8  data[8];
+	//   __u32 len;
+	//   __u8  is_write;
+	// } mmio;
+	kvmRunMMIOPhysAddrOffset = 0
+	kvmRunMMIODataOffset     = 8
+	kvmRunMMIOLenOffset      = 16
+	kvmRunMMIOIsWriteOffset  = 20
+
+	// struct {
+	//   __u64 hardware_entry_failure_reason;
+	//   __u32 cpu;
+	// } fail_entry;
+	kvmRunFailEntryReasonOffset = 0
+
+	// struct {
+	//   __u32 suberror;
+	//   __u32 ndata;
+	//   __u64 data[16];
+	// } internal;
+	kvmRunInternalSuberrorOffset = 0
+)
+
+// Exit reasons reported in kvm_run.exit_reason.
+const (
+	kvmExitUnknown       = 0
+	kvmExitIO            = 2
+	kvmExitHLT           = 5
+	kvmExitMMIO          = 6
+	kvmExitShutdown      = 8
+	kvmExitFailEntry     = 9
+	kvmExitInternalError = 17
+)
+
+// VCPU is a single virtual CPU belonging to a VM, created by calling
+// VM.CreateVCPU. It wraps the VCPU file descriptor along with the mmapped
+// kvm_run page shared with the kernel, used to run guest code and decode
+// why it stopped running. Callers must call Close once a VCPU is no
+// longer needed, to release the fd and unmap the kvm_run page.
+type VCPU struct {
+	fd uintptr
+
+	// ioctl syscall implementation
+	ioctl ioctlFunc
+
+	// run is the mmapped kvm_run shared memory page for this VCPU.
+	run []byte
+
+	// vm is the VM that created this VCPU, used by RunUntil to reach its
+	// registered device Bus.
+	vm *VM
+}
+
+// Close unmaps the kvm_run page and closes the underlying VCPU file
+// descriptor. It must be called once a VCPU created by VM.CreateVCPU is
+// no longer needed; otherwise both are leaked for the life of the
+// process.
+func (vc *VCPU) Close() error {
+	err := syscall.Munmap(vc.run)
+	if cerr := syscall.Close(int(vc.fd)); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// IODirection indicates whether an ExitIO was triggered by a guest IN or
+// OUT instruction.
+type IODirection uint8
+
+// Possible IODirection values, taken from the "direction" field of the
+// kvm_run io exit union.
+const (
+	IODirectionIn  IODirection = 0
+	IODirectionOut IODirection = 1
+)
+
+// Exit describes why a call to (*VCPU).Run returned control to userspace,
+// as decoded from kvm_run.exit_reason. It is implemented by ExitHLT,
+// ExitIO, ExitMMIO, ExitShutdown, ExitFailEntry, ExitInternalError and
+// ExitUnknown.
+type Exit interface {
+	// isExit restricts implementations of Exit to this package.
+	isExit()
+}
+
+// ExitHLT indicates the guest executed a HLT instruction.
+type ExitHLT struct{}
+
+func (ExitHLT) isExit() {}
+
+// ExitIO indicates the guest executed an IN or OUT instruction that must
+// be serviced by userspace. Data aliases the kvm_run page at
+// data_offset, so writes made to it before the next call to Run are
+// visible to the guest on an IN.
+type ExitIO struct {
+	Direction IODirection
+	Size      uint8
+	Port      uint16
+	Count     uint32
+	Data      []byte
+}
+
+func (ExitIO) isExit() {}
+
+// ExitMMIO indicates the guest accessed a physical address that isn't
+// backed by a memory slot, and must be serviced by userspace. Data
+// aliases the fixed 8-byte buffer in the kvm_run page, sliced to Len
+// bytes. On a write (IsWrite true) it holds the value the guest wrote; on
+// a read, writes made to it before the next call to Run are visible to
+// the guest.
+type ExitMMIO struct {
+	PhysAddr uint64
+	Data     []byte
+	Len      uint32
+	IsWrite  bool
+}
+
+func (ExitMMIO) isExit() {}
+
+// ExitShutdown indicates the guest triple-faulted or otherwise requested
+// a shutdown.
+type ExitShutdown struct{}
+
+func (ExitShutdown) isExit() {}
+
+// ExitFailEntry indicates the VCPU could not be entered at all; the
+// reason is hardware-specific.
+type ExitFailEntry struct {
+	HardwareEntryFailureReason uint64
+}
+
+func (ExitFailEntry) isExit() {}
+
+// ExitInternalError indicates KVM encountered an internal error it
+// could not handle.
+type ExitInternalError struct {
+	Suberror uint32
+}
+
+func (ExitInternalError) isExit() {}
+
+// ExitUnknown is returned for any exit_reason darity does not yet decode
+// into a more specific Exit.
+type ExitUnknown struct {
+	Reason uint32
+}
+
+func (ExitUnknown) isExit() {}
+
+// Run issues KVM_RUN, causing the guest to execute starting at its
+// current register state until it halts, shuts down, or generates an
+// I/O or MMIO access that userspace must service. The returned Exit
+// describes why execution stopped; the caller should inspect it, take
+// any action required (e.g. populating ExitIO.Data on an IN), and call
+// Run again to resume the guest.
+func (vc *VCPU) Run() (Exit, error) {
+	if _, err := vc.ioctl(vc.fd, kvmRun, 0); err != nil {
+		return nil, err
+	}
+
+	reason := binary.LittleEndian.Uint32(vc.run[kvmRunExitReasonOffset:])
+
+	switch reason {
+	case kvmExitHLT:
+		return ExitHLT{}, nil
+	case kvmExitShutdown:
+		return ExitShutdown{}, nil
+	case kvmExitIO:
+		return vc.decodeExitIO(), nil
+	case kvmExitMMIO:
+		return vc.decodeExitMMIO(), nil
+	case kvmExitFailEntry:
+		u := kvmRunExitUnionOffset
+		return ExitFailEntry{
+			HardwareEntryFailureReason: binary.LittleEndian.Uint64(vc.run[u+kvmRunFailEntryReasonOffset:]),
+		}, nil
+	case kvmExitInternalError:
+		u := kvmRunExitUnionOffset
+		return ExitInternalError{
+			Suberror: binary.LittleEndian.Uint32(vc.run[u+kvmRunInternalSuberrorOffset:]),
+		}, nil
+	default:
+		return ExitUnknown{Reason: reason}, nil
+	}
+}
+
+// decodeExitIO decodes the kvm_run io exit union into an ExitIO.
+func (vc *VCPU) decodeExitIO() Exit {
+	u := kvmRunExitUnionOffset
+
+	direction := vc.run[u+kvmRunIODirectionOffset]
+	size := vc.run[u+kvmRunIOSizeOffset]
+	port := binary.LittleEndian.Uint16(vc.run[u+kvmRunIOPortOffset:])
+	count := binary.LittleEndian.Uint32(vc.run[u+kvmRunIOCountOffset:])
+	dataOffset := binary.LittleEndian.Uint64(vc.run[u+kvmRunIODataOffset:])
+
+	n := uint64(size) * uint64(count)
+
+	return ExitIO{
+		Direction: IODirection(direction),
+		Size:      size,
+		Port:      port,
+		Count:     count,
+		Data:      vc.run[dataOffset : dataOffset+n],
+	}
+}
+
+// requestImmediateExit sets kvm_run.immediate_exit, asking an in-flight
+// or not-yet-started call to Run to return as soon as possible. See
+// RunUntil.
+func (vc *VCPU) requestImmediateExit() {
+	vc.run[kvmRunImmediateExitOffset] = 1
+}
+
+// clearImmediateExit resets kvm_run.immediate_exit, undoing a prior call
+// to requestImmediateExit so a subsequent Run actually enters guest mode.
+func (vc *VCPU) clearImmediateExit() {
+	vc.run[kvmRunImmediateExitOffset] = 0
+}
+
+// decodeExitMMIO decodes the kvm_run mmio exit union into an ExitMMIO.
+func (vc *VCPU) decodeExitMMIO() Exit {
+	u := kvmRunExitUnionOffset
+
+	physAddr := binary.LittleEndian.Uint64(vc.run[u+kvmRunMMIOPhysAddrOffset:])
+	length := binary.LittleEndian.Uint32(vc.run[u+kvmRunMMIOLenOffset:])
+	isWrite := vc.run[u+kvmRunMMIOIsWriteOffset] != 0
+
+	data := vc.run[u+kvmRunMMIODataOffset : u+kvmRunMMIODataOffset+8]
+
+	return ExitMMIO{
+		PhysAddr: physAddr,
+		Data:     data[:length],
+		Len:      length,
+		IsWrite:  isWrite,
+	}
+}
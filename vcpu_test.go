@@ -0,0 +1,109 @@
+// +build linux
+
+package darity
+
+import (
+	"encoding/binary"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// newTestRunPage returns a zeroed kvm_run page large enough to exercise
+// every exit union this package decodes.
+func newTestRunPage() []byte {
+	return make([]byte, kvmRunExitUnionOffset+64)
+}
+
+// TestVCPURunExitHLT verifies that Run decodes a HLT exit_reason into an
+// ExitHLT.
+func TestVCPURunExitHLT(t *testing.T) {
+	run := newTestRunPage()
+	binary.LittleEndian.PutUint32(run[kvmRunExitReasonOffset:], kvmExitHLT)
+
+	vc := &VCPU{
+		run: run,
+		ioctl: func(fd uintptr, request int, argp uintptr) (uintptr, error) {
+			if request != kvmRun {
+				t.Fatalf("unexpected ioctl request number: %d", request)
+			}
+			return 0, nil
+		},
+	}
+
+	exit, err := vc.Run()
+	if err != nil {
+		t.Fatalf("could not run VCPU: %q", err.Error())
+	}
+
+	if _, ok := exit.(ExitHLT); !ok {
+		t.Fatalf("unexpected exit type: %#v", exit)
+	}
+}
+
+// TestVCPURunExitIO verifies that Run decodes an IO exit_reason into an
+// ExitIO whose Data aliases the kvm_run page at data_offset.
+func TestVCPURunExitIO(t *testing.T) {
+	run := newTestRunPage()
+	binary.LittleEndian.PutUint32(run[kvmRunExitReasonOffset:], kvmExitIO)
+
+	u := kvmRunExitUnionOffset
+	const dataOffset = 48
+
+	run[u+kvmRunIODirectionOffset] = byte(IODirectionIn)
+	run[u+kvmRunIOSizeOffset] = 1
+	binary.LittleEndian.PutUint16(run[u+kvmRunIOPortOffset:], 0x3f8)
+	binary.LittleEndian.PutUint32(run[u+kvmRunIOCountOffset:], 1)
+	binary.LittleEndian.PutUint64(run[u+kvmRunIODataOffset:], dataOffset)
+	run[dataOffset] = 'A'
+
+	vc := &VCPU{
+		run: run,
+		ioctl: func(fd uintptr, request int, argp uintptr) (uintptr, error) {
+			return 0, nil
+		},
+	}
+
+	exit, err := vc.Run()
+	if err != nil {
+		t.Fatalf("could not run VCPU: %q", err.Error())
+	}
+
+	io, ok := exit.(ExitIO)
+	if !ok {
+		t.Fatalf("unexpected exit type: %#v", exit)
+	}
+
+	if want, got := uint16(0x3f8), io.Port; want != got {
+		t.Fatalf("unexpected port: %#x != %#x", want, got)
+	}
+
+	if want, got := byte('A'), io.Data[0]; want != got {
+		t.Fatalf("unexpected IO data: %q != %q", want, got)
+	}
+}
+
+// TestVCPUClose verifies that Close unmaps the kvm_run page and closes
+// the VCPU's fd.
+func TestVCPUClose(t *testing.T) {
+	run, err := syscall.Mmap(-1, 0, kvmRunExitUnionOffset+64, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		t.Fatalf("could not mmap test run page: %q", err.Error())
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("could not create pipe: %q", err.Error())
+	}
+	defer r.Close()
+
+	vc := &VCPU{fd: w.Fd(), run: run}
+
+	if err := vc.Close(); err != nil {
+		t.Fatalf("could not close VCPU: %q", err.Error())
+	}
+
+	if err := w.Close(); err == nil {
+		t.Fatal("expected fd to already be closed by VCPU.Close")
+	}
+}